@@ -139,6 +139,17 @@ def load_template(language, project_type):
     # Convert project_type to filename: "cli-calculator" -> "cli_calculator"
     template_name = project_type.replace("-", "_")
 
+    # A directory template, like the Go module in templates/go/http_server, is copied whole
+    project_dir = os.path.join(template_dir, template_name)
+    if os.path.isdir(project_dir):
+        files = {}
+        for root, _, names in os.walk(project_dir):
+            for name in names:
+                path = os.path.join(root, name)
+                with open(path, "r") as f:
+                    files[os.path.relpath(path, project_dir)] = f.read()
+        return files
+
     # Try exact match first
     for ext in [".py", ".js", ".java", ".c", ".go", ".txt"]:
         path = os.path.join(template_dir, template_name + ext)
@@ -642,6 +653,7 @@ def create_project(config, dry_run=False):
     # Write project files
     for filename, content in files.items():
         filepath = os.path.join(project_path, filename)
+        os.makedirs(os.path.dirname(filepath), exist_ok=True)
         with open(filepath, "w") as f:
             f.write(content)
         print(f"  📝 Created: {filename}")
@@ -0,0 +1,3 @@
+module github.com/iamjaysingh/daily-auto-projects/templates/go/http_server
+
+go 1.24
@@ -0,0 +1,14 @@
+/*
+ * HTTP Server
+ * A simple HTTP server with routing and JSON responses.
+ * Author: Jay Singh (iamjaysingh)
+ * Run: go run main.go
+ */
+
+package main
+
+import "github.com/iamjaysingh/daily-auto-projects/templates/go/http_server/server"
+
+func main() {
+	server.Main()
+}
@@ -0,0 +1,1602 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCluster is a set of Raft nodes talking over local test servers; setting down[i]
+// cuts node i off from the others in both directions
+type testCluster struct {
+	nodes []*RaftNode
+	down  []*atomic.Bool
+	dirs  []string
+}
+
+// cutTransport fails every request while down is set
+type cutTransport struct{ down *atomic.Bool }
+
+func (t cutTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.down.Load() {
+		return nil, fmt.Errorf("node is cut off")
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func quietLogger() Logger {
+	logger, _ := NewLogger(io.Discard, "console", "error")
+	return logger
+}
+
+func startCluster(t *testing.T, size, snapshotEvery int) *testCluster {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	c := &testCluster{}
+	servers := make([]*httptest.Server, size)
+	urls := make([]string, size)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		urls[i] = "http://" + servers[i].Listener.Addr().String()
+		c.dirs = append(c.dirs, t.TempDir())
+	}
+	for i := range servers {
+		peers := make(map[string]string)
+		for j, u := range urls {
+			if j != i {
+				peers[fmt.Sprintf("n%d", j)] = u
+			}
+		}
+		n, err := NewRaftNode(fmt.Sprintf("n%d", i), peers, "s3cret", c.dirs[i], newShardedStore(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.logger = quietLogger()
+		n.snapshotEvery = snapshotEvery
+		router := NewRouter()
+		n.registerRaftRoutes(router)
+		down := new(atomic.Bool)
+		n.client = &http.Client{Transport: cutTransport{down}}
+		servers[i].Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if down.Load() {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			}
+			router.ServeHTTP(w, r)
+		})
+		servers[i].Start()
+		t.Cleanup(servers[i].Close)
+		c.nodes = append(c.nodes, n)
+		c.down = append(c.down, down)
+		go n.Run(ctx)
+	}
+	return c
+}
+
+// waitFor polls cond until it holds or the deadline passes
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// leader waits for a leader that can take writes, skipping nodes that are down
+func (c *testCluster) leader(t *testing.T) *RaftNode {
+	t.Helper()
+	var leader *RaftNode
+	waitFor(t, "a leader", func() bool {
+		for i, n := range c.nodes {
+			n.mu.Lock()
+			ready := n.state == "leader" && n.lastApplied >= n.barrier
+			n.mu.Unlock()
+			if ready && !c.down[i].Load() {
+				leader = n
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func TestRaftElectsOneLeaderPerTerm(t *testing.T) {
+	c := startCluster(t, 3, 0)
+	leader := c.leader(t)
+	leader.mu.Lock()
+	term := leader.term
+	leader.mu.Unlock()
+	for _, n := range c.nodes {
+		n.mu.Lock()
+		if n != leader && n.state == "leader" && n.term == term {
+			t.Errorf("%s and %s both lead term %d", n.id, leader.id, term)
+		}
+		n.mu.Unlock()
+	}
+
+	// Cutting the leader off makes the others elect a new one in a later term
+	for i, n := range c.nodes {
+		if n == leader {
+			c.down[i].Store(true)
+		}
+	}
+	next := c.leader(t)
+	next.mu.Lock()
+	defer next.mu.Unlock()
+	if next == leader || next.term <= term {
+		t.Errorf("new leader %s in term %d, want a node other than %s after term %d", next.id, next.term, leader.id, term)
+	}
+}
+
+func TestRaftReplicatesCommittedWrites(t *testing.T) {
+	c := startCluster(t, 3, 0)
+	leader := c.leader(t)
+	for i := 0; i < 5; i++ {
+		if _, err := leader.store.Create(Task{Title: fmt.Sprintf("task %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range c.nodes {
+		waitFor(t, n.id+" to apply the writes", func() bool { return n.store.Len() == 5 })
+	}
+	for _, n := range c.nodes {
+		if n == leader {
+			continue
+		}
+		if _, err := n.store.Create(Task{Title: "on a follower"}); err != errNotLeader {
+			t.Errorf("write on follower %s: got %v, want errNotLeader", n.id, err)
+		}
+	}
+}
+
+func TestRaftSnapshotCatchesUpLaggingFollower(t *testing.T) {
+	c := startCluster(t, 3, 4)
+	leader := c.leader(t)
+	lagging := 0
+	for lagging < len(c.nodes) && c.nodes[lagging] == leader {
+		lagging++
+	}
+	c.down[lagging].Store(true)
+	for i := 0; i < 12; i++ {
+		if _, err := leader.store.Create(Task{Title: fmt.Sprintf("task %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the leader to compact its log", func() bool {
+		leader.mu.Lock()
+		defer leader.mu.Unlock()
+		return leader.base > 0
+	})
+
+	c.down[lagging].Store(false)
+	n := c.nodes[lagging]
+	waitFor(t, "the lagging follower to catch up", func() bool { return n.store.Len() == 12 })
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.base == 0 {
+		t.Error("lagging follower caught up without a snapshot")
+	}
+}
+
+func TestRaftRestartKeepsTermVoteAndLog(t *testing.T) {
+	dir := t.TempDir()
+	n, err := NewRaftNode("n0", nil, "s3cret", dir, newShardedStore(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.logger = quietLogger()
+	n.snapshotEvery = 4
+	ctx, cancel := context.WithCancel(context.Background())
+	go n.Run(ctx)
+	c := &testCluster{nodes: []*RaftNode{n}, down: []*atomic.Bool{new(atomic.Bool)}}
+	c.leader(t)
+	for i := 0; i < 5; i++ {
+		if _, err := n.store.Create(Task{Title: fmt.Sprintf("task %d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	n.mu.Lock()
+	term, base := n.term, n.base
+	n.mu.Unlock()
+	if base == 0 {
+		t.Fatal("log was never compacted")
+	}
+
+	again, err := NewRaftNode("n0", nil, "s3cret", dir, newShardedStore(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again.logger = quietLogger()
+	if again.term != term || again.votedFor != "n0" {
+		t.Errorf("restarted with term %d vote %q, want term %d vote n0", again.term, again.votedFor, term)
+	}
+	// The snapshot holds the tasks up to base (index 1 is the first term's no-op)
+	if again.base != base || again.store.Len() != base-1 {
+		t.Errorf("restarted with snapshot at %d holding %d tasks, want %d and %d", again.base, again.store.Len(), base, base-1)
+	}
+	// Entries after the snapshot come back too, and apply once the node leads again
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go again.Run(ctx)
+	c.nodes[0] = again
+	c.leader(t)
+	if again.store.Len() != 5 {
+		t.Errorf("restarted node has %d tasks, want 5", again.store.Len())
+	}
+	if task, err := again.store.Create(Task{Title: "after restart"}); err != nil || task.ID != 6 {
+		t.Errorf("write after restart: task %d, %v; want task 6", task.ID, err)
+	}
+}
+
+func TestRaftVoteIsDurable(t *testing.T) {
+	dir := t.TempDir()
+	n, err := NewRaftNode("n0", map[string]string{"n1": "http://127.0.0.1:1"}, "s3cret", dir, newShardedStore(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := n.handleVote(voteRequest{Term: 5, CandidateID: "n1"}); !resp.Granted {
+		t.Fatal("vote not granted")
+	}
+	again, err := NewRaftNode("n0", map[string]string{"n1": "http://127.0.0.1:1"}, "s3cret", dir, newShardedStore(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.term != 5 || again.votedFor != "n1" {
+		t.Fatalf("after restart term %d vote %q, want 5 n1", again.term, again.votedFor)
+	}
+	if resp := again.handleVote(voteRequest{Term: 5, CandidateID: "n2"}); resp.Granted {
+		t.Error("voted twice in term 5")
+	}
+}
+
+func TestRaftRejectsRPCsWithoutSecret(t *testing.T) {
+	n, err := NewRaftNode("n0", nil, "s3cret", t.TempDir(), newShardedStore(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+	n.registerRaftRoutes(router)
+	for _, path := range []string{"/raft/vote", "/raft/append", "/raft/snapshot"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", path, nil))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s without the secret: %d, want 403", path, rec.Code)
+		}
+	}
+	if _, err := NewRaftNode("n0", nil, "", t.TempDir(), newShardedStore(1)); err == nil {
+		t.Error("NewRaftNode accepted an empty cluster secret")
+	}
+}
+
+func TestParseTaskTextDueNeedsBoundary(t *testing.T) {
+	now := time.Date(2026, 10, 14, 9, 0, 0, 0, time.UTC) // a Wednesday
+	for _, tc := range []struct{ text, title, due string }{
+		{"Call Monday Corp", "Call Monday Corp", ""},
+		{"Call Monday Corp tomorrow", "Call Monday Corp", "tomorrow"},
+		{"Monday standup notes", "standup notes", "Monday"},
+		{"Call mom friday #family !high", "Call mom", "friday"},
+		{"Send invoice by friday to Bob", "Send invoice to Bob", "by friday"},
+		{"Buy 3 days of food", "Buy 3 days of food", ""},
+	} {
+		d := parseTaskText(tc.text, now)
+		if d.Title != tc.title || d.DueText != tc.due {
+			t.Errorf("parseTaskText(%q) = title %q due %q, want %q and %q", tc.text, d.Title, d.DueText, tc.title, tc.due)
+		}
+	}
+}
+
+func TestLocalizedErrorsThroughWrappingMiddleware(t *testing.T) {
+	c := DefaultConfig()
+	c.OpenAPIValidate = true
+	srv, err := New(WithConfig(c), WithLogger(quietLogger()), WithStore(newShardedStore(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := httptest.NewRequest("GET", "/api/tasks/999", nil)
+	get.Header.Set("Accept-Language", "es")
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, get)
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "tarea no encontrada") {
+		t.Fatalf("GET with -openapi-validate: %d %s, want a 404 in Spanish", rec.Code, rec.Body)
+	}
+
+	// HEAD answers for the same localized body, without sending it
+	head := httptest.NewRequest("HEAD", "/api/tasks/999", nil)
+	head.Header.Set("Accept-Language", "es")
+	hrec := httptest.NewRecorder()
+	srv.ServeHTTP(hrec, head)
+	if got, want := hrec.Header().Get("Content-Length"), strconv.Itoa(rec.Body.Len()); got != want || hrec.Body.Len() != 0 {
+		t.Errorf("HEAD: Content-Length %s with %d body bytes, want %s and none", got, hrec.Body.Len(), want)
+	}
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	k, err := ParseKeyring("first secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := k.Seal([]byte("buy milk"))
+	if bytes.Contains(sealed, []byte("milk")) {
+		t.Fatalf("sealed text shows the plain text: %s", sealed)
+	}
+	if parts := strings.Split(string(sealed), ":"); len(parts) != 4 || parts[0] != "enc" {
+		t.Fatalf("sealed %q, want enc:<id>:<salt>:<ciphertext>", sealed)
+	}
+	// A fresh keyring, as after a restart, reads it back from the stored salt
+	again, _ := ParseKeyring("first secret")
+	plain, current, err := again.Open(sealed)
+	if err != nil || string(plain) != "buy milk" || !current {
+		t.Fatalf("Open = %q, current %v, %v; want buy milk, current", plain, current, err)
+	}
+	// and keeps sealing with that salt, so the KDF runs once
+	if resealed := again.Seal([]byte("x")); strings.Split(string(resealed), ":")[2] != strings.Split(string(sealed), ":")[2] {
+		t.Error("Seal after Open picked a new salt")
+	}
+	other, _ := ParseKeyring("first secret")
+	if a, b := strings.Split(string(other.Seal(nil)), ":")[2], strings.Split(string(sealed), ":")[2]; a == b {
+		t.Error("two keyrings that saw no data share a salt")
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old, _ := ParseKeyring("old secret")
+	sealed := old.Seal([]byte("notes"))
+
+	rotated, _ := ParseKeyring("new secret, old secret")
+	plain, current, err := rotated.Open(sealed)
+	if err != nil || string(plain) != "notes" || current {
+		t.Fatalf("Open under the old key = %q, current %v, %v; want notes, not current", plain, current, err)
+	}
+	resealed := rotated.Seal(plain)
+	if _, current, err := rotated.Open(resealed); err != nil || !current {
+		t.Errorf("resealed data: current %v, %v; want current", current, err)
+	}
+	if _, _, err := old.Open(resealed); !errors.Is(err, errNoEncryptionKey) {
+		t.Errorf("old keyring opening data under the new key: %v, want errNoEncryptionKey", err)
+	}
+}
+
+func TestKeyringOpensUnsaltedData(t *testing.T) {
+	// What Seal wrote before keys were salted: AES-GCM under SHA-256 of the secret
+	key := sha256.Sum256([]byte("s"))
+	fp := sha256.Sum256(key[:])
+	aead := newGCM(key[:])
+	nonce := make([]byte, aead.NonceSize())
+	legacy := fmt.Sprintf("enc:%x:%s", fp[:4], base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte("older"), nil)))
+
+	k, _ := ParseKeyring("s")
+	plain, current, err := k.Open([]byte(legacy))
+	if err != nil || string(plain) != "older" || current {
+		t.Fatalf("Open = %q, current %v, %v; want older, not current so compaction rewrites it", plain, current, err)
+	}
+	if strings.Contains(string(k.Seal(plain)), fmt.Sprintf("%x", fp[:4])) {
+		t.Error("new ciphertext still carries the unsalted key's fingerprint")
+	}
+}
+
+func TestResolveSecretNeedsPrefix(t *testing.T) {
+	t.Setenv("TASKSERVER_TEST_SECRET", "hunter2")
+	ctx := context.Background()
+	for in, want := range map[string]string{
+		"env:TASKSERVER_TEST_SECRET":        "env:TASKSERVER_TEST_SECRET",
+		"secret:env:TASKSERVER_TEST_SECRET": "hunter2",
+		"secret:literal:secret:env:X":       "secret:env:X",
+		"plain":                             "plain",
+		"postgres://app:secret:env:TASKSERVER_TEST_SECRET@db/tasks": "postgres://app:hunter2@db/tasks",
+	} {
+		got, err := ResolveSecret(ctx, in)
+		if strings.Contains(in, "://") {
+			got, err = resolveDSNSecret(ctx, in)
+		}
+		if err != nil || got != want {
+			t.Errorf("resolving %q = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ResolveSecret(ctx, "secret:nope:x"); err == nil {
+		t.Error("an unknown provider resolved without an error")
+	}
+}
+
+func TestGitHubWebhookAcceptsDuplicateDelivery(t *testing.T) {
+	gh := NewGitHubSync("https://api.github.test", "o/r", "", "whs", NewStore(1), nil, func() bool { return true })
+	body := `{"action":"opened","issue":{"number":7,"title":"Fix the lights","state":"open"},"repository":{"full_name":"o/r"}}`
+	mac := hmac.New(sha256.New, []byte("whs"))
+	mac.Write([]byte(body))
+	for i, want := range []string{"applied", "duplicate"} {
+		req := httptest.NewRequest("POST", "/api/integrations/github/webhook", strings.NewReader(body))
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		req.Header.Set("X-GitHub-Event", "issues")
+		req.Header.Set("X-GitHub-Delivery", "d-1")
+		rec := httptest.NewRecorder()
+		gh.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("delivery %d: %d %s, want 200 %s", i+1, rec.Code, rec.Body, want)
+		}
+	}
+}
+
+func TestAuthGuardLocksUserNamesOnlyWhenAsked(t *testing.T) {
+	for _, perUser := range []bool{false, true} {
+		g := NewAuthGuard(2, time.Minute, time.Minute, time.Hour)
+		g.perUser = perUser
+		g.Fail("203.0.113.7", "al", "/api/tasks")
+		g.Fail("203.0.113.8", "al", "/api/tasks")
+		if g.Locked("198.51.100.1", "al") > 0 != perUser {
+			t.Errorf("perUser %v: al locked out from a fresh IP = %v", perUser, !perUser)
+		}
+		g.Fail("203.0.113.7", "bo", "/api/tasks")
+		if g.Locked("203.0.113.7", "cy") == 0 {
+			t.Errorf("perUser %v: an IP with two failures is not locked out", perUser)
+		}
+	}
+}
+
+func TestAttachmentDownloadNeedsOwnerOrAdmin(t *testing.T) {
+	svc := NewTaskService(NewStore(1))
+	svc.attachments = NewAttachmentStore("", nil)
+	sum, _ := svc.attachments.Put([]byte("hello"))
+	task, _ := svc.store.Create(Task{Title: "Receipt", Owner: "al", Attachments: []Attachment{{ID: 1, Name: "r.txt", ContentType: "text/plain", Size: 5, SHA256: sum}}})
+	h := handleTaskItem(svc, "fs", "at")
+	for _, tc := range []struct {
+		name string
+		auth func(*http.Request)
+		want int
+	}{
+		{"anonymous", func(*http.Request) {}, http.StatusNotFound},
+		{"another user", func(r *http.Request) { r.SetBasicAuth("bo", feedToken("fs", "bo")) }, http.StatusNotFound},
+		{"owner", func(r *http.Request) { r.SetBasicAuth("al", feedToken("fs", "al")) }, http.StatusOK},
+		{"admin", func(r *http.Request) { r.Header.Set("Authorization", "Bearer at") }, http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/tasks/%d/attachments/1", task.ID), nil)
+		tc.auth(req)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: %d, want %d", tc.name, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestBackupAndRestoreCarryAttachments(t *testing.T) {
+	src := t.TempDir()
+	sum, err := NewAttachmentStore(src, nil).Put([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data, manifest, err := NewBackups(NewStore(1), src, nil, "", 0).Archive(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "attachments/" + sum[:2] + "/" + sum
+	if !strings.Contains(strings.Join(manifest.Files, " "), name) {
+		t.Fatalf("manifest files %v lack %s", manifest.Files, name)
+	}
+	archive := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := os.WriteFile(archive, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if ok, err := runRestore(io.Discard, []string{"-data-dir", dst, "-storage", "memory", archive}); err != nil || !ok {
+		t.Fatalf("restore: %v, %v", ok, err)
+	}
+	if got, err := NewAttachmentStore(dst, nil).Get(sum); err != nil || string(got) != "hello" {
+		t.Errorf("restored attachment = %q, %v", got, err)
+	}
+}
+
+// qrHelloWorld is "hello, world" as version 1-M with mask 0, checked against a decoder
+// written separately from EncodeQR: the format bits match the standard's table, the
+// Reed-Solomon codewords verify, and the payload reads back
+var qrHelloWorld = []string{
+	"#######..#.##.#######",
+	"#.....#.##..#.#.....#",
+	"#.###.#..#..#.#.###.#",
+	"#.###.#...##..#.###.#",
+	"#.###.#.#..##.#.###.#",
+	"#.....#....#..#.....#",
+	"#######.#.#.#.#######",
+	"..........#..........",
+	"#.#.#.#..#..#...#..#.",
+	"#.##...###.#....#..##",
+	".#..####.###.#.######",
+	"####.#.######..#...#.",
+	".######.#.##....#....",
+	"........##.#..###.###",
+	"#######..#..##..#.###",
+	"#.....#....#...#...#.",
+	"#.###.#.##.###.#...#.",
+	"#.###.#..#.###.##.##.",
+	"#.###.#.#..##...#.#.#",
+	"#.....#..#.#....#..#.",
+	"#######.####...#...##",
+}
+
+func TestEncodeQRGolden(t *testing.T) {
+	qr, err := EncodeQR([]byte("hello, world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qr.Version != 1 || qr.Size != 21 {
+		t.Fatalf("version %d, size %d; want 1, 21", qr.Version, qr.Size)
+	}
+	for y, want := range qrHelloWorld {
+		var got strings.Builder
+		for _, dark := range qr.Modules[y] {
+			if dark {
+				got.WriteByte('#')
+			} else {
+				got.WriteByte('.')
+			}
+		}
+		if got.String() != want {
+			t.Errorf("row %2d = %s\n    want %s", y, got.String(), want)
+		}
+	}
+}
+
+func TestWriteQR(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeQR(rec, "hello, world", "png")
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("PNG: %v", err)
+	}
+	// 21 modules and a quiet zone of 4 on each side, 8 pixels a module
+	if b := img.Bounds(); b.Dx() != 232 || b.Dy() != 232 {
+		t.Errorf("PNG is %v, want 232x232", b)
+	}
+	for y, row := range qrHelloWorld {
+		for x, c := range row {
+			r, _, _, _ := img.At((x+qrQuietZone)*8+4, (y+qrQuietZone)*8+4).RGBA()
+			if dark := r < 0x8000; dark != (c == '#') {
+				t.Fatalf("pixel for module (%d, %d): dark %v, want %v", x, y, dark, c == '#')
+			}
+		}
+	}
+	rec = httptest.NewRecorder()
+	writeQR(rec, "hello, world", "svg")
+	if ct := rec.Header().Get("Content-Type"); ct != "image/svg+xml" || !strings.Contains(rec.Body.String(), "<svg") {
+		t.Errorf("SVG answer: %s %.40q", ct, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	writeQR(rec, strings.Repeat("x", 3000), "png")
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("oversized payload: %d, want 422", rec.Code)
+	}
+}
+
+// newTestServer builds a Server on memory storage with the feed secret "fs" and the
+// admin token "at"; edit adjusts the config first
+func newTestServer(t *testing.T, edit func(*Config)) *Server {
+	t.Helper()
+	c := DefaultConfig()
+	c.Storage, c.DataDir = "memory", t.TempDir()
+	c.FeedSecret, c.AdminToken = "fs", "at"
+	if edit != nil {
+		edit(&c)
+	}
+	s, err := New(WithConfig(c), WithLogger(quietLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// serve sends one request through s; auth is "" for anonymous, "Bearer ..." as it
+// stands, or "user:password" for Basic auth
+func serve(s http.Handler, method, target, auth, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if user, pass, ok := strings.Cut(auth, ":"); ok && !strings.HasPrefix(auth, "Bearer ") {
+		r.SetBasicAuth(user, pass)
+	} else if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestOnlyOwnersAndAdminsChangeTasks(t *testing.T) {
+	for _, requireAuth := range []bool{false, true} {
+		s := newTestServer(t, func(c *Config) { c.RequireAuth = requireAuth })
+		al, bo := "al:"+feedToken("fs", "al"), "bo:"+feedToken("fs", "bo")
+		rec := serve(s, "POST", "/api/tasks", "", `{"title":"Anyone's"}`)
+		if want := map[bool]int{false: 201, true: 401}[requireAuth]; rec.Code != want {
+			t.Errorf("require-auth %v: anonymous create = %d, want %d", requireAuth, rec.Code, want)
+		}
+		rec = serve(s, "POST", "/api/tasks", al, `{"title":"Al's"}`)
+		if rec.Code != 201 {
+			t.Fatalf("require-auth %v: al's create = %d %s", requireAuth, rec.Code, rec.Body)
+		}
+		var task Task
+		json.Unmarshal(rec.Body.Bytes(), &task)
+		item := fmt.Sprintf("/api/tasks/%d", task.ID)
+		for _, step := range []struct {
+			name, method, target, auth, body string
+			want                             int
+		}{
+			{"anonymous delete", "DELETE", item, "", "", map[bool]int{false: 404, true: 401}[requireAuth]},
+			{"bo's delete", "DELETE", item, bo, "", 404},
+			{"bo's move", "POST", item + "/move", bo, `{"index":0}`, 404},
+			{"bo's completion", "POST", "/api/tasks/complete", bo, fmt.Sprintf(`{"ids":[%d]}`, task.ID), 404},
+			{"bo's checklist item", "POST", item + "/checklist", bo, `{"text":"x"}`, 404},
+			{"anonymous read", "GET", item, "", "", 200},
+			{"al's move", "POST", item + "/move", al, `{"index":0}`, 200},
+			{"admin delete", "DELETE", item, "Bearer at", "", 204},
+		} {
+			if rec := serve(s, step.method, step.target, step.auth, step.body); rec.Code != step.want {
+				t.Errorf("require-auth %v: %s = %d, want %d: %s", requireAuth, step.name, rec.Code, step.want, rec.Body)
+			}
+		}
+	}
+}
+
+func TestWrongCredentialsAreRefusedAndLockOut(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.AuthMaxFailures = 2 })
+	for _, auth := range []string{"al:wrong", "Bearer wrong"} {
+		if rec := serve(s, "POST", "/api/tasks", auth, `{"title":"Guess"}`); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: %d, want 401", auth, rec.Code)
+		}
+	}
+	if rec := serve(s, "POST", "/api/tasks", "al:"+feedToken("fs", "al"), `{"title":"Real"}`); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("the right feed token after two failures: %d, want 429", rec.Code)
+	}
+	if rec := serve(s, "GET", "/api/tasks", "", ""); rec.Code != http.StatusOK {
+		t.Errorf("anonymous read during the lockout: %d, want 200", rec.Code)
+	}
+}
+
+func TestAPITokenLifecycle(t *testing.T) {
+	ts, _ := LoadAPITokens("", "fs")
+	clock := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	ts.now = func() time.Time { return clock }
+	router := NewRouter()
+	router.RequireAuth = true
+	router.Handle("/api/tokens", ts)
+	router.Handle("/api/tokens/", ts)
+	router.HandleFunc("/api/tasks", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	h := ts.Guard(Authenticate("fs", "at", router))
+	al := "al:" + feedToken("fs", "al")
+
+	mint := func(name, scopes string) (APIToken, string) {
+		t.Helper()
+		body := fmt.Sprintf(`{"name":%q,"scopes":%s,"expires_at":%q}`, name, scopes, clock.Add(time.Hour).Format(time.RFC3339))
+		rec := serve(h, "POST", "/api/tokens", al, body)
+		var out struct {
+			Token  APIToken `json:"token"`
+			Secret string   `json:"secret"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &out); rec.Code != http.StatusCreated || err != nil || !strings.HasPrefix(out.Secret, apiTokenPrefix) {
+			t.Fatalf("creating %s: %d %s", name, rec.Code, rec.Body)
+		}
+		clock = clock.Add(time.Second) // List sorts by creation time
+		return out.Token, out.Secret
+	}
+	_, ci := mint("ci", `["tasks:read"]`)
+	cli, cliSecret := mint("cli", `["tasks:read","tasks:write"]`)
+	if rec := serve(h, "POST", "/api/tokens", al, `{"name":"admin","scopes":["admin"]}`); rec.Code != http.StatusForbidden {
+		t.Errorf("minting a scope al lacks: %d, want 403", rec.Code)
+	}
+
+	var list struct{ Tokens []APIToken }
+	json.Unmarshal(serve(h, "GET", "/api/tokens", al, "").Body.Bytes(), &list)
+	if len(list.Tokens) != 2 || list.Tokens[0].Name != "ci" || list.Tokens[0].Hash != "" {
+		t.Errorf("al's tokens = %+v", list.Tokens)
+	}
+	for _, step := range []struct {
+		name, method, auth string
+		want               int
+	}{
+		{"read-only token reads", "GET", "Bearer " + ci, http.StatusNoContent},
+		{"read-only token writes", "POST", "Bearer " + ci, http.StatusForbidden},
+		{"read-write token writes", "POST", "Bearer " + cliSecret, http.StatusNoContent},
+		{"anonymous write", "POST", "", http.StatusUnauthorized},
+		{"unknown token", "GET", "Bearer " + apiTokenPrefix + "nope", http.StatusUnauthorized},
+	} {
+		if rec := serve(h, step.method, "/api/tasks", step.auth, ""); rec.Code != step.want {
+			t.Errorf("%s: %d, want %d", step.name, rec.Code, step.want)
+		}
+	}
+
+	if rec := serve(h, "DELETE", "/api/tokens/"+cli.ID, "bo:"+feedToken("fs", "bo"), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("bo revoking al's token: %d, want 404", rec.Code)
+	}
+	if rec := serve(h, "DELETE", "/api/tokens/"+cli.ID, al, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("al revoking a token: %d, want 204", rec.Code)
+	}
+	if rec := serve(h, "POST", "/api/tasks", "Bearer "+cliSecret, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token: %d, want 401", rec.Code)
+	}
+	clock = clock.Add(2 * time.Hour)
+	if rec := serve(h, "GET", "/api/tasks", "Bearer "+ci, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expired token: %d, want 401", rec.Code)
+	}
+}
+
+func TestQuotasCoverAnonymousCallers(t *testing.T) {
+	q := NewUsageQuotas("fs", 2, NewStore(1))
+	h := q.Enforce(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }))
+	call := func(ip, auth string) int {
+		r := httptest.NewRequest("GET", "/api/tasks", nil)
+		r.RemoteAddr = ip + ":4711"
+		if auth != "" {
+			r.SetBasicAuth(auth, feedToken("fs", auth))
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	call("203.0.113.7", "")
+	call("203.0.113.7", "")
+	if code := call("203.0.113.7", ""); code != http.StatusTooManyRequests {
+		t.Errorf("third anonymous request from one IP: %d, want 429", code)
+	}
+	if code := call("203.0.113.8", ""); code != http.StatusNoContent {
+		t.Errorf("anonymous request from another IP: %d, want 204", code)
+	}
+	if code := call("203.0.113.7", "al"); code != http.StatusNoContent {
+		t.Errorf("al from the spent IP: %d, want 204", code)
+	}
+
+	s := newTestServer(t, func(c *Config) { c.MaxTasksPerUser = 1 })
+	if rec := serve(s, "POST", "/api/tasks", "", `{"title":"Ownerless"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous create under -max-tasks-per-user: %d, want 401", rec.Code)
+	}
+	al := "al:" + feedToken("fs", "al")
+	serve(s, "POST", "/api/tasks", al, `{"title":"First"}`)
+	if rec := serve(s, "POST", "/api/tasks", al, `{"title":"Second"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("al's second task past a cap of 1: %d, want 403", rec.Code)
+	}
+}
+
+func TestRestartRefusesMemoryStorage(t *testing.T) {
+	s := newTestServer(t, nil)
+	rec := serve(s, "POST", "/api/admin/restart", "Bearer at", "")
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "-storage memory") {
+		t.Errorf("restart on memory storage: %d %s, want 409", rec.Code, rec.Body)
+	}
+}
+
+func TestCalDAVAdvertisesNoLocking(t *testing.T) {
+	s := newTestServer(t, nil)
+	rec := serve(s, "OPTIONS", "/caldav/al/", "al:"+feedToken("fs", "al"), "")
+	if got := rec.Header().Get("DAV"); got != "1, calendar-access" {
+		t.Errorf("DAV = %q, want 1, calendar-access", got)
+	}
+}
+
+func TestReadOnlyRoutesRefuseOtherMethods(t *testing.T) {
+	s := newTestServer(t, nil)
+	for _, path := range []string{"/api/stats", "/api/changes", "/api/feed.atom", "/metrics", "/openapi.json"} {
+		if rec := serve(s, "GET", path, "", ""); rec.Code != http.StatusOK {
+			t.Errorf("GET %s: %d, want 200", path, rec.Code)
+		}
+		for _, method := range []string{"PUT", "DELETE"} {
+			if rec := serve(s, method, path, "Bearer at", ""); rec.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%s %s: %d, want 405", method, path, rec.Code)
+			}
+		}
+	}
+}
+
+func TestMethodNotAllowedListsHeadAndOptions(t *testing.T) {
+	s := newTestServer(t, nil)
+	serve(s, "POST", "/api/tasks", "", `{"title":"One"}`)
+	rec := serve(s, "PATCH", "/api/tasks/1", "", "{}")
+	var body struct{ Allowed []string }
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if got := rec.Header().Get("Allow"); rec.Code != http.StatusMethodNotAllowed || got != "GET, HEAD, DELETE, OPTIONS" {
+		t.Errorf("PATCH /api/tasks/1: %d, Allow %q", rec.Code, got)
+	}
+	if got := strings.Join(body.Allowed, ", "); got != rec.Header().Get("Allow") {
+		t.Errorf("allowed = %q, Allow header %q", got, rec.Header().Get("Allow"))
+	}
+	if rec := serve(s, "OPTIONS", "/api/tasks/1", "", ""); rec.Code != http.StatusNoContent || !strings.Contains(rec.Header().Get("Allow"), "DELETE") {
+		t.Errorf("OPTIONS /api/tasks/1: %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
+
+func TestRootListsRoutesUnderBasePath(t *testing.T) {
+	for _, base := range []string{"", "/tasks"} {
+		s := newTestServer(t, func(c *Config) { c.BasePath = base })
+		rec := serve(s, "GET", base+"/", "", "")
+		var body struct{ Routes []string }
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		if len(body.Routes) == 0 || body.Routes[0] != "GET  "+base+"/api/tasks    - List all tasks" {
+			t.Errorf("base path %q: routes = %q", base, body.Routes)
+		}
+	}
+}
+
+func TestDeleteIfMatch(t *testing.T) {
+	s := newTestServer(t, nil)
+	for _, tc := range []struct {
+		name, ifMatch, query string
+		gone                 bool // the task was deleted before the request
+		want                 int
+	}{
+		{"no precondition", "", "", false, http.StatusNoContent},
+		{"the current tag", "current", "", false, http.StatusNoContent},
+		{"one of several tags", `"stale", current`, "", false, http.StatusNoContent},
+		{"any tag", "*", "", false, http.StatusNoContent},
+		{"a stale tag", `"stale"`, "", false, http.StatusPreconditionFailed},
+		{"gone", "", "", true, http.StatusNotFound},
+		{"gone, idempotent", "", "?idempotent=true", true, http.StatusNoContent},
+		{"gone, any tag", "*", "", true, http.StatusPreconditionFailed},
+		{"gone, any tag, idempotent", "*", "?idempotent=true", true, http.StatusPreconditionFailed},
+	} {
+		rec := serve(s, "POST", "/api/tasks", "", `{"title":"Doomed"}`)
+		var task Task
+		json.Unmarshal(rec.Body.Bytes(), &task)
+		item := fmt.Sprintf("/api/tasks/%d", task.ID)
+		tag := serve(s, "GET", item, "", "").Header().Get("ETag")
+		if tc.gone {
+			serve(s, "DELETE", item, "", "")
+		}
+		r := httptest.NewRequest("DELETE", item+tc.query, nil)
+		if tc.ifMatch != "" {
+			r.Header.Set("If-Match", strings.ReplaceAll(tc.ifMatch, "current", tag))
+		}
+		got := httptest.NewRecorder()
+		s.ServeHTTP(got, r)
+		if got.Code != tc.want {
+			t.Errorf("%s: %d, want %d: %s", tc.name, got.Code, tc.want, got.Body)
+		}
+		if tc.want == http.StatusPreconditionFailed && !tc.gone {
+			if rec := serve(s, "GET", item, "", ""); rec.Code != http.StatusOK {
+				t.Errorf("%s: the task is gone after a 412", tc.name)
+			}
+		}
+	}
+}
+
+func TestAttachmentBytesLimit(t *testing.T) {
+	store := NewStore(1)
+	store.limits = StoreLimits{MaxAttachmentBytes: 10}
+	file := func(size int64) []Attachment { return []Attachment{{ID: 1, Name: "f", Size: size}} }
+	first, err := store.Create(Task{Title: "First", Attachments: file(6)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create(Task{Title: "Second", Attachments: file(6)}); !errors.Is(err, ErrStorageFull) {
+		t.Errorf("12 of 10 bytes: %v, want ErrStorageFull", err)
+	}
+	if got := store.Usage().AttachmentBytes; got != 6 {
+		t.Errorf("attachment bytes = %d, want 6", got)
+	}
+	if err := store.Delete(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create(Task{Title: "Second", Attachments: file(6)}); err != nil {
+		t.Errorf("after the delete freed 6 bytes: %v", err)
+	}
+
+	s := newTestServer(t, func(c *Config) { c.MaxAttachmentBytes = 1 << 20 })
+	var stats struct{ Usage StoreUsage }
+	json.Unmarshal(serve(s, "GET", "/api/stats", "", "").Body.Bytes(), &stats)
+	if stats.Usage.MaxAttachmentBytes != 1<<20 {
+		t.Errorf("/api/stats usage = %+v", stats.Usage)
+	}
+}
+
+func TestAttachmentStoreLimit(t *testing.T) {
+	dir := t.TempDir()
+	a := NewAttachmentStore(dir, nil)
+	if err := a.Limit(12); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Put([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Put([]byte("hello")); err != nil {
+		t.Errorf("the same file again, stored once: %v", err)
+	}
+	if _, err := a.Put([]byte("a whole lot")); !errors.Is(err, ErrStorageFull) {
+		t.Errorf("16 of 12 bytes: %v, want ErrStorageFull", err)
+	}
+	reopened := NewAttachmentStore(dir, nil)
+	if err := reopened.Limit(12); err != nil {
+		t.Fatal(err)
+	}
+	if used, max := reopened.Usage(); used != 5 || max != 12 {
+		t.Errorf("after reopening: %d of %d bytes, want 5 of 12", used, max)
+	}
+
+	svc := NewTaskService(NewStore(1))
+	svc.attachments = reopened
+	e := NewEmailIngest("tasks@example.com", "", "", 1<<20, svc)
+	e.logger = quietLogger()
+	before := len(svc.List(""))
+	mail := "From: al@example.com\r\nSubject: Receipt\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nSee attached\r\n" +
+		"--b\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=big.txt\r\n\r\nmore than seven bytes\r\n--b--\r\n"
+	if code, reply := e.deliver("al@example.com", []string{"tasks@example.com"}, []byte(mail)); code != 552 {
+		t.Errorf("mail past the attachment limit: %d %s, want 552", code, reply)
+	}
+	if n := len(svc.List("")) - before; n != 0 {
+		t.Errorf("%d tasks made from refused mail", n)
+	}
+}
+
+// openTestWAL opens a file store in dir without the demo tasks; the log is closed with the test
+func openTestWAL(t *testing.T, dir string) *Store {
+	t.Helper()
+	s, err := openFileStore(dir, 1, false, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.wal.f.Close() })
+	return s
+}
+
+func titles(s *Store) string {
+	var out []string
+	for _, t := range s.GetAll() {
+		out = append(out, t.Title)
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
+
+func TestWALDropsTornLastLine(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestWAL(t, dir)
+	s.Create(Task{Title: "a"})
+	s.Create(Task{Title: "b"})
+	log := filepath.Join(dir, "tasks.wal")
+	whole, _ := os.ReadFile(log)
+	os.WriteFile(log, append(whole, `1234abcd {"op":"put","task":{"id":3,"ti`...), 0o644)
+
+	s = openTestWAL(t, dir)
+	if got := titles(s); got != "a,b" {
+		t.Errorf("after a torn write: %q, want a,b", got)
+	}
+	if after, _ := os.ReadFile(log); !bytes.Equal(after, whole) {
+		t.Errorf("the torn tail was kept: %d bytes, want %d", len(after), len(whole))
+	}
+	if c, err := s.Create(Task{Title: "c"}); err != nil || c.ID != 3 {
+		t.Fatalf("create after recovery: %+v, %v", c, err)
+	}
+	if got := titles(openTestWAL(t, dir)); got != "a,b,c" {
+		t.Errorf("a record appended after recovery: %q, want a,b,c", got)
+	}
+}
+
+func TestWALStopsAtChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestWAL(t, dir)
+	for _, title := range []string{"a", "b", "c"} {
+		s.Create(Task{Title: title})
+	}
+	log := filepath.Join(dir, "tasks.wal")
+	data, _ := os.ReadFile(log)
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	copy(lines[1], "00000000") // b's checksum no longer matches; c follows it
+	os.WriteFile(log, bytes.Join(lines, nil), 0o644)
+
+	s = openTestWAL(t, dir)
+	if got := titles(s); got != "a" {
+		t.Errorf("after a bad checksum: %q, want only the records before it", got)
+	}
+	if after, _ := os.ReadFile(log); len(after) != len(lines[0]) {
+		t.Errorf("log is %d bytes, want it cut to the %d of the last good record", len(after), len(lines[0]))
+	}
+}
+
+func TestWALReplaysOverSnapshotAfterCrashBeforeTruncate(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestWAL(t, dir)
+	a, _ := s.Create(Task{Title: "a"})
+	b, _ := s.Create(Task{Title: "b"})
+	s.Update(a.ID, func(t *Task) error { t.Title = "a2"; return nil })
+	s.Delete(b.ID)
+	s.Create(Task{Title: "c"})
+	log := filepath.Join(dir, "tasks.wal")
+	unsnapshotted, _ := os.ReadFile(log)
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// A crash after the snapshot's rename but before the truncate leaves both in place
+	os.WriteFile(log, unsnapshotted, 0o644)
+
+	s = openTestWAL(t, dir)
+	if got := titles(s); got != "a2,c" {
+		t.Errorf("snapshot plus the old log: %q, want a2,c", got)
+	}
+	if d, err := s.Create(Task{Title: "d"}); err != nil || d.ID != 4 {
+		t.Errorf("next create: %+v, %v, want ID 4", d, err)
+	}
+}
+
+func TestWithTxRollsBack(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fn   func(cancel context.CancelFunc) func(tx *StoreTx) error
+		want error
+	}{
+		{"fn fails", func(context.CancelFunc) func(tx *StoreTx) error {
+			return func(tx *StoreTx) error {
+				tx.Create(Task{Title: "c"})
+				tx.Update(1, func(t *Task) error { t.Title = "renamed"; return nil })
+				tx.Delete(2, nil)
+				return ErrInvalid
+			}
+		}, ErrInvalid},
+		{"ctx cancelled inside fn", func(cancel context.CancelFunc) func(tx *StoreTx) error {
+			return func(tx *StoreTx) error {
+				tx.Create(Task{Title: "c"})
+				cancel()
+				return nil
+			}
+		}, context.Canceled},
+		{"over the task limit", func(context.CancelFunc) func(tx *StoreTx) error {
+			return func(tx *StoreTx) error {
+				tx.Update(1, func(t *Task) error { t.Title = "renamed"; return nil })
+				tx.Create(Task{Title: "c"})
+				tx.Create(Task{Title: "d"})
+				return nil
+			}
+		}, ErrStorageFull},
+	} {
+		for _, driver := range []string{"memory", "file"} {
+			dir := t.TempDir()
+			store := newShardedStore(2)
+			if driver == "file" {
+				store = openTestWAL(t, dir)
+			}
+			store.Create(Task{Title: "a"})
+			store.Create(Task{Title: "b"})
+			store.limits = StoreLimits{MaxTasks: 3}
+			ctx, cancel := context.WithCancel(context.Background())
+			err := store.WithTx(ctx, tc.fn(cancel))
+			cancel()
+			if !errors.Is(err, tc.want) {
+				t.Errorf("%s, %s: %v, want %v", tc.name, driver, err, tc.want)
+			}
+			if got := titles(store); got != "a,b" {
+				t.Errorf("%s, %s: tasks %q after the rollback, want a,b", tc.name, driver, got)
+			}
+			if got := store.Usage().Tasks; got != 2 {
+				t.Errorf("%s, %s: usage counts %d tasks, want 2", tc.name, driver, got)
+			}
+			if driver == "file" {
+				store.wal.f.Close()
+				if got := titles(openTestWAL(t, dir)); got != "a,b" {
+					t.Errorf("%s: replayed %q, want a,b", tc.name, got)
+				}
+			}
+		}
+	}
+
+	store := NewStore(1)
+	before := titles(store)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ran := false
+	if err := store.WithTx(ctx, func(*StoreTx) error { ran = true; return nil }); !errors.Is(err, context.Canceled) || ran {
+		t.Errorf("a cancelled ctx: err %v, fn ran %v", err, ran)
+	}
+	if titles(store) != before {
+		t.Errorf("a cancelled ctx changed the store")
+	}
+}
+
+func TestBatchIsAllOrNothing(t *testing.T) {
+	s := newTestServer(t, nil)
+	before := titles(s.store)
+	for _, tc := range []struct {
+		name, body, wantErr string
+		want                int
+	}{
+		{"a missing task", `{"operations":[{"op":"create","task":{"title":"New"}},{"op":"update","id":999,"task":{"title":"x"}}]}`,
+			"operation 2", http.StatusNotFound},
+		{"an unknown op", `{"operations":[{"op":"create","task":{"title":"New"}},{"op":"archive","id":1}]}`,
+			"operation 2", http.StatusBadRequest},
+		{"no operations", `{"operations":[]}`, "", http.StatusBadRequest},
+	} {
+		rec := serve(s, "POST", "/api/batch", "", tc.body)
+		if rec.Code != tc.want || !strings.Contains(rec.Body.String(), tc.wantErr) {
+			t.Errorf("%s: %d %s, want %d naming %q", tc.name, rec.Code, rec.Body, tc.want, tc.wantErr)
+		}
+		if got := titles(s.store); got != before {
+			t.Errorf("%s: tasks %q, want %q", tc.name, got, before)
+		}
+	}
+
+	rec := serve(s, "POST", "/api/batch", "", `{"operations":[{"op":"create","task":{"title":"New"}},{"op":"update","id":1,"task":{"title":"Renamed"}},{"op":"delete","id":2}]}`)
+	var body struct{ Results []BatchResult }
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusOK || len(body.Results) != 3 {
+		t.Fatalf("batch: %d %s", rec.Code, rec.Body)
+	}
+	if _, err := s.store.Get(2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("task 2 after the batch deleted it: %v", err)
+	}
+	if task, _ := s.store.Get(1); task.Title != "Renamed" {
+		t.Errorf("task 1 = %q, want Renamed", task.Title)
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		col   int // 0 when the query parses
+		msg   string
+	}{
+		{"done:false AND (tag:work OR priority:high)", 0, ""},
+		{"not done:true", 0, ""},
+		{"colour:red", 1, `unknown field "colour"`},
+		{"1abc", 1, "expected a field name"},
+		{"tag", 4, "expected an operator"},
+		{"tag=>a", 4, `unknown operator "=>"`},
+		{"tag:", 5, "expected a value"},
+		{"done:maybe", 6, "needs true or false"},
+		{`title:"open`, 7, "unterminated quoted value"},
+		{"priority>=urgent", 11, "not \"urgent\""},
+		{"due<tomorrowish", 5, "is not a date"},
+		{"tag:a OR", 9, "where a term was expected"},
+		{"done:true )", 11, "unexpected )"},
+		{"(done:true", 1, "unclosed parenthesis"},
+	} {
+		_, err := ParseQuery(tc.query)
+		if tc.col == 0 {
+			if err != nil {
+				t.Errorf("%q: %v", tc.query, err)
+			}
+			continue
+		}
+		var syntaxErr *QuerySyntaxError
+		if !errors.As(err, &syntaxErr) || !errors.Is(err, ErrInvalid) {
+			t.Errorf("%q: %v, want a QuerySyntaxError", tc.query, err)
+			continue
+		}
+		if syntaxErr.Pos+1 != tc.col || !strings.Contains(err.Error(), tc.msg) || !strings.Contains(err.Error(), fmt.Sprintf("column %d:", tc.col)) {
+			t.Errorf("%q: %v, want column %d and %q", tc.query, err, tc.col, tc.msg)
+		}
+	}
+}
+
+func TestDecodeJSONIsStrict(t *testing.T) {
+	for _, tc := range []struct {
+		name, contentType, body string
+		want                    error
+		msg                     string
+	}{
+		{"ok", "application/json; charset=utf-8", `{"title":"a"}`, nil, ""},
+		{"not json", "text/plain", `{"title":"a"}`, ErrUnsupportedMediaType, ""},
+		{"no content type", "", `{"title":"a"}`, ErrUnsupportedMediaType, ""},
+		{"empty", "application/json", ``, ErrInvalid, "body is empty"},
+		{"truncated", "application/json", `{"title":"a"`, ErrInvalid, "ends mid-document"},
+		{"syntax", "application/json", `{"title" "a"}`, ErrInvalid, "malformed JSON at byte 10"},
+		{"wrong type", "application/json", `{"title":1}`, ErrInvalid, `field "title" at byte 10 must be string, not number`},
+		{"unknown field", "application/json", `{"title":"a","colour":"red"}`, ErrInvalid, `unknown field "colour"`},
+		{"trailing data", "application/json", `{"title":"a"} {}`, ErrInvalid, "after the JSON document"},
+		{"too large", "application/json", `{"title":"` + strings.Repeat("a", maxJSONBody) + `"}`, nil, ""},
+	} {
+		r := httptest.NewRequest("POST", "/api/tasks", strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			r.Header.Set("Content-Type", tc.contentType)
+		}
+		var v struct {
+			Title string `json:"title"`
+		}
+		err := decodeJSON(httptest.NewRecorder(), r, &v)
+		if tc.name == "too large" {
+			if errorStatus(err) != http.StatusRequestEntityTooLarge {
+				t.Errorf("%s: %v answers %d, want 413", tc.name, err, errorStatus(err))
+			}
+			continue
+		}
+		if !errors.Is(err, tc.want) || tc.want == nil && err != nil {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+		}
+		if err != nil && !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("%s: %v, want %q", tc.name, err, tc.msg)
+		}
+	}
+}
+
+func TestShareLinks(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+	live := signShare("fs", shareClaims{Task: 7, User: "al", Expires: now.Add(time.Hour).Unix()})
+	body, sig, _ := strings.Cut(live, ".")
+	forged, _ := json.Marshal(shareClaims{Task: 8, User: "al", Expires: now.Add(time.Hour).Unix()})
+	for _, tc := range []struct {
+		name, secret, token string
+		now                 time.Time
+		ok                  bool
+	}{
+		{"live", "fs", live, now, true},
+		{"a second before expiry", "fs", live, now.Add(time.Hour - time.Second), true},
+		{"at expiry", "fs", live, now.Add(time.Hour), false},
+		{"another secret", "other", live, now, false},
+		{"no secret", "", live, now, false},
+		{"forged claims", "fs", base64.RawURLEncoding.EncodeToString(forged) + "." + sig, now, false},
+		{"truncated signature", "fs", body + "." + sig[:len(sig)-2], now, false},
+		{"no signature", "fs", body, now, false},
+		{"garbage", "fs", "not.a-token", now, false},
+	} {
+		claims, ok := openShare(tc.secret, tc.token, tc.now)
+		if ok != tc.ok || ok && (claims.Task != 7 || claims.User != "al") {
+			t.Errorf("%s: %+v, %v, want ok %v", tc.name, claims, ok, tc.ok)
+		}
+	}
+
+	for _, tc := range []struct {
+		expires string
+		want    time.Duration // 0 for an error
+	}{
+		{"", shareDefaultAge},
+		{"24h", 24 * time.Hour},
+		{"30d", 30 * 24 * time.Hour},
+		{"90d", shareMaxAge},
+		{"91d", 0},
+		{"0s", 0},
+		{"-1h", 0},
+		{"soon", 0},
+	} {
+		got, err := shareAge(tc.expires)
+		if got != tc.want || (err != nil) != (tc.want == 0) {
+			t.Errorf("expires=%q: %v, %v, want %v", tc.expires, got, err, tc.want)
+		}
+	}
+
+	s := newTestServer(t, nil)
+	al := "al:" + feedToken("fs", "al")
+	s.store.Update(1, func(t *Task) error { t.Owner = "al"; return nil })
+	if rec := serve(s, "GET", "/api/tasks/1/share", "bo:"+feedToken("fs", "bo"), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("sharing another user's task: %d, want 404", rec.Code)
+	}
+	rec := serve(s, "GET", "/api/tasks/1/share?expires=1h", al, "")
+	var link ShareLink
+	json.Unmarshal(rec.Body.Bytes(), &link)
+	if rec.Code != http.StatusOK || !strings.Contains(link.URL, "/share/") {
+		t.Fatalf("share: %d %s", rec.Code, rec.Body)
+	}
+	view := httptest.NewRequest("GET", link.URL[strings.Index(link.URL, "/share/"):], nil)
+	view.Header.Set("Accept", "application/json")
+	got := httptest.NewRecorder()
+	s.ServeHTTP(got, view)
+	if got.Code != http.StatusOK || strings.Contains(got.Body.String(), `"owner"`) {
+		t.Errorf("shared view: %d %s", got.Code, got.Body)
+	}
+	if rec := serve(s, "GET", "/share/"+live, "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("a link signed for another server: %d, want 404", rec.Code)
+	}
+}
+
+func TestPublicBoardPasswords(t *testing.T) {
+	hashed := hashBoardPassword("open sesame")
+	if hashed == hashBoardPassword("open sesame") {
+		t.Error("two hashes of one password share a salt")
+	}
+	parts := strings.Split(hashed, "$")
+	for _, tc := range []struct {
+		name, hashed, password string
+		want                   bool
+	}{
+		{"right password", hashed, "open sesame", true},
+		{"wrong password", hashed, "open sesame!", false},
+		{"empty password", hashed, "", false},
+		{"another scheme", "bcrypt$" + strings.Join(parts[1:], "$"), "open sesame", false},
+		{"fewer iterations", strings.Join([]string{parts[0], "1", parts[2], parts[3]}, "$"), "open sesame", false},
+		{"no iterations", strings.Join([]string{parts[0], "0", parts[2], parts[3]}, "$"), "open sesame", false},
+		{"bad salt", strings.Join([]string{parts[0], parts[1], "!!", parts[3]}, "$"), "open sesame", false},
+		{"no hash", "", "", false},
+	} {
+		if got := checkBoardPassword(tc.hashed, tc.password); got != tc.want {
+			t.Errorf("%s: %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	s := newTestServer(t, nil)
+	al := "al:" + feedToken("fs", "al")
+	rec := serve(s, "POST", "/api/public-boards", al, `{"project":"home","password":"open sesame"}`)
+	var created struct {
+		PublicBoard PublicBoard `json:"public_board"`
+		URL         string
+	}
+	json.Unmarshal(rec.Body.Bytes(), &created)
+	if rec.Code != http.StatusCreated || !created.PublicBoard.Protected || created.PublicBoard.Password != "" {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	board := created.URL[strings.Index(created.URL, "/public/"):]
+	for _, tc := range []struct {
+		name, auth string
+		want       int
+	}{
+		{"no password", "", http.StatusUnauthorized},
+		{"wrong password", "any:wrong", http.StatusUnauthorized},
+		{"right password, any user name", "any:open sesame", http.StatusOK},
+	} {
+		if rec := serve(s, "GET", board, tc.auth, ""); rec.Code != tc.want {
+			t.Errorf("%s: %d, want %d", tc.name, rec.Code, tc.want)
+		} else if tc.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no Basic challenge", tc.name)
+		}
+	}
+	serve(s, "PATCH", "/api/public-boards/"+created.PublicBoard.ID, al, `{"password":""}`)
+	if rec := serve(s, "GET", board, "", ""); rec.Code != http.StatusOK {
+		t.Errorf("after removing the password: %d, want 200", rec.Code)
+	}
+}
+
+// Benchmarks print the standard Go format, so two runs can be compared with benchstat
+// (see `make bench-compare`). The Store/Query and Store/Stats ones list from
+// -bench-tasks tasks: go test -run '^$' -bench Store/Query ... -args -bench-tasks 100000
+var benchTasks = flag.Int("bench-tasks", 1_000_000, "number of tasks the query benchmarks list from")
+
+// Filtered listing: every 100th task is open, every 1000th tagged "rare",
+// and about half have a due date spread over two years
+var bigBench struct {
+	once  sync.Once
+	store *Store
+}
+
+func bigBenchStore() *Store {
+	bigBench.once.Do(func() {
+		big := newShardedStore(64)
+		base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < *benchTasks; i++ {
+			t := Task{Title: "bench", Labels: []string{"common"}, Done: i%100 != 0}
+			if i%1000 == 0 {
+				t.Labels = append(t.Labels, "rare")
+			}
+			if i%2 == 0 {
+				due := base.Add(time.Duration(i%730) * 24 * time.Hour)
+				t.DueDate = &due
+			}
+			big.Create(t)
+		}
+		bigBench.store = big
+	})
+	return bigBench.store
+}
+
+func BenchmarkStore(b *testing.B) {
+	for _, shards := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("Add/shards=%d", shards), func(b *testing.B) {
+			s := newShardedStore(shards)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					s.Add("bench")
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("Mixed/shards=%d", shards), func(b *testing.B) {
+			s := newShardedStore(shards)
+			for i := 0; i < 1024; i++ {
+				s.Add("seed")
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					i++
+					if i%4 == 0 {
+						s.Add("bench")
+					} else {
+						s.Toggle(i%1024 + 1)
+					}
+				}
+			})
+		})
+	}
+
+	for _, q := range []struct{ name, src string }{
+		{"tag", "tag:rare"},
+		{"open_tag", "done:false AND tag:rare"},
+		{"open_due", "done:false AND due<2024-02-01"},
+		{"unindexed", "title:bench priority:high"},
+	} {
+		parsed, err := ParseQuery(q.src)
+		if err != nil {
+			b.Fatal(err)
+		}
+		filter := TaskFilter{Query: parsed, Env: QueryEnv{Now: time.Now(), Loc: time.UTC}}
+		for _, mode := range []string{"scan", "indexed"} {
+			useIndex := mode == "indexed"
+			b.Run(fmt.Sprintf("Query/%s/%s/tasks=%d", q.name, mode, *benchTasks), func(b *testing.B) {
+				s := bigBenchStore()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := s.queryMemory(context.Background(), filter, "", Page{}, useIndex); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+
+	// Stats from the incrementally kept cache against a full recount
+	b.Run(fmt.Sprintf("Stats/cached/tasks=%d", *benchTasks), func(b *testing.B) {
+		s := bigBenchStore()
+		s.Stats()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.Stats()
+		}
+	})
+	b.Run(fmt.Sprintf("Stats/recount/tasks=%d", *benchTasks), func(b *testing.B) {
+		s := bigBenchStore()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			s.stats.mu.Lock()
+			s.stats.valid = false
+			s.stats.mu.Unlock()
+			s.Stats()
+		}
+	})
+}
+
+func BenchmarkJSON(b *testing.B) {
+	due := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	task := Task{ID: 42, Title: "Write the quarterly report", Project: "ops", Labels: []string{"work", "urgent"}, Priority: "high", DueDate: &due, Position: 42, CreatedAt: due.AddDate(0, 0, -7)}
+	list := make([]Task, 100)
+	for i := range list {
+		list[i] = task
+		list[i].ID = i + 1
+	}
+	encoded, _ := json.Marshal(task)
+	b.Run("EncodeTask", func(b *testing.B) {
+		enc := json.NewEncoder(io.Discard)
+		for i := 0; i < b.N; i++ {
+			enc.Encode(task)
+		}
+	})
+	b.Run("EncodeList/tasks=100", func(b *testing.B) {
+		enc := json.NewEncoder(io.Discard)
+		for i := 0; i < b.N; i++ {
+			enc.Encode(map[string]interface{}{"count": len(list), "tasks": list})
+		}
+	})
+	// writeJSON against encoding straight into the response, as it did before pooling
+	b.Run("WriteJSON/task/direct", func(b *testing.B) {
+		w := &benchWriter{header: http.Header{}}
+		for i := 0; i < b.N; i++ {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(task)
+		}
+	})
+	b.Run("WriteJSON/task/pooled", func(b *testing.B) {
+		w := &benchWriter{header: http.Header{}}
+		for i := 0; i < b.N; i++ {
+			writeJSON(w, http.StatusOK, task)
+		}
+	})
+	b.Run("WriteJSON/list=100/direct", func(b *testing.B) {
+		w := &benchWriter{header: http.Header{}}
+		for i := 0; i < b.N; i++ {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]interface{}{"count": len(list), "tasks": list})
+		}
+	})
+	b.Run("WriteJSON/list=100/pooled", func(b *testing.B) {
+		w := &benchWriter{header: http.Header{}}
+		for i := 0; i < b.N; i++ {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"count": len(list), "tasks": list})
+		}
+	})
+	b.Run("DecodeTask", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var t Task
+			if err := json.Unmarshal(encoded, &t); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// /api/tasks/{id} path parsing against the strings.Split it replaced
+func BenchmarkRouting(b *testing.B) {
+	paths := []string{"/api/tasks/42/checklist", "/api/tasks/42/checklist/7", "/api/tasks/42/timer/start"}
+	b.Run("TaskItemPath/split", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			parts := strings.Split(strings.Trim(strings.TrimPrefix(paths[i%len(paths)], "/api/tasks/"), "/"), "/")
+			if id, err := strconv.Atoi(parts[0]); err != nil || id != 42 || len(parts) < 2 {
+				b.Fatal("bad parse")
+			}
+		}
+	})
+	b.Run("TaskItemPath/cut", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if id, _, _, ok := taskItemPath(paths[i%len(paths)]); !ok || id != 42 {
+				b.Fatal("bad parse")
+			}
+		}
+	})
+}
+
+// End to end through the router and the global middleware, as main wires them
+func BenchmarkHandler(b *testing.B) {
+	handler := func(tasks int) http.Handler {
+		store := newShardedStore(16)
+		for i := 0; i < tasks; i++ {
+			store.Create(Task{Title: fmt.Sprintf("task %d", i), Labels: []string{"bench"}})
+		}
+		svc := NewTaskService(store)
+		settings, _ := LoadSettings("", "")
+		logger, _ := NewLogger(io.Discard, "json", "error")
+		router := NewRouter()
+		router.HandleFunc("/api/tasks", handleTasks(store, svc, settings))
+		router.HandleFunc("/api/tasks/", handleTaskItem(svc, "", ""))
+		return LogRequests(logger, Localize(settings, router))
+	}
+	for _, c := range []struct{ name, method, target, body string }{
+		{"ListTasks/tasks=100", "GET", "/api/tasks", ""},
+		{"QueryTasks/tasks=100", "GET", "/api/tasks?query=tag:bench&sort=-created&limit=20", ""},
+		{"CreateTask", "POST", "/api/tasks", `{"title":"Write the quarterly report","labels":["work"],"priority":"high"}`},
+		{"Checklist", "GET", "/api/tasks/42/checklist", ""},
+		{"NotFound", "GET", "/api/nope", ""},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			h := handler(100)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var body io.Reader
+				if c.body != "" {
+					body = strings.NewReader(c.body)
+				}
+				r, _ := http.NewRequest(c.method, c.target, body)
+				if c.body != "" {
+					r.Header.Set("Content-Type", "application/json")
+				}
+				w := &benchWriter{header: http.Header{}}
+				h.ServeHTTP(w, r)
+				if w.code >= 500 {
+					b.Fatalf("%s %s: status %d", c.method, c.target, w.code)
+				}
+			}
+		})
+	}
+}
+
+// benchWriter is a ResponseWriter that keeps only the status code
+type benchWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *benchWriter) Header() http.Header { return w.header }
+
+func (w *benchWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *benchWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(p), nil
+}